@@ -0,0 +1,383 @@
+package doh
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// bootstrapRefreshInterval is how often cached bootstrap resolutions are
+// proactively refreshed, independent of their TTL.
+const bootstrapRefreshInterval = 5 * time.Minute
+
+// bootstrapTimeout bounds a single bootstrap lookup against one server.
+const bootstrapTimeout = 3 * time.Second
+
+// bootstrapMinTTL is the shortest time a bootstrap answer is cached for;
+// record TTLs below it are raised to it.
+const bootstrapMinTTL = 60 * time.Second
+
+// WithBootstrap resolves the hostnames used by provider URLs (e.g.
+// "cloudflare-dns.com" in "https://cloudflare-dns.com/dns-query") via
+// plain DNS against addrs, instead of the system resolver, avoiding the
+// chicken-and-egg problem of needing DNS to dial a DNS-over-HTTPS
+// provider. Each addr is a "host:port" or bare host (defaulting to port
+// 53). Results are cached honoring TTL and refreshed periodically in the
+// background; on timeout, resolution falls back to the next bootstrap
+// server in order.
+func WithBootstrap(addrs []string) Option {
+	return func(d *DoH) {
+		b := newBootstrapResolver(addrs)
+		d.bootstrap = b
+
+		transport, ok := d.httpClient.Transport.(*http.Transport)
+		if !ok {
+			transport = &http.Transport{}
+			d.httpClient.Transport = transport
+		}
+		transport.DialContext = b.dialContext
+	}
+}
+
+// bootstrapResolver resolves DoH provider hostnames via plain DNS and
+// installs itself as an http.Transport.DialContext, dialing the resolved
+// IPs directly while leaving the original host:port (and thus SNI and the
+// Host header) untouched.
+type bootstrapResolver struct {
+	addrs []string
+
+	mu    sync.RWMutex
+	cache map[string]bootstrapEntry
+
+	stopc chan struct{}
+	wg    sync.WaitGroup
+}
+
+type bootstrapEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+func newBootstrapResolver(addrs []string) *bootstrapResolver {
+	b := &bootstrapResolver{
+		addrs: addrs,
+		cache: make(map[string]bootstrapEntry),
+		stopc: make(chan struct{}),
+	}
+
+	b.wg.Add(1)
+	go b.refreshLoop()
+
+	return b
+}
+
+// Close stops the background refresh goroutine.
+func (b *bootstrapResolver) Close() {
+	close(b.stopc)
+	b.wg.Wait()
+}
+
+func (b *bootstrapResolver) refreshLoop() {
+	defer b.wg.Done()
+
+	t := time.NewTicker(bootstrapRefreshInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-b.stopc:
+			return
+		case <-t.C:
+			b.refreshAll()
+		}
+	}
+}
+
+func (b *bootstrapResolver) refreshAll() {
+	b.mu.RLock()
+	hosts := make([]string, 0, len(b.cache))
+	for h := range b.cache {
+		hosts = append(hosts, h)
+	}
+	b.mu.RUnlock()
+
+	for _, h := range hosts {
+		for _, server := range b.addrs {
+			ips, ttl, err := lookupHost(server, h)
+			if err != nil {
+				continue
+			}
+
+			b.mu.Lock()
+			b.cache[h] = bootstrapEntry{ips: ips, expires: time.Now().Add(ttl)}
+			b.mu.Unlock()
+			break
+		}
+	}
+}
+
+// dialContext is installed as the http.Transport's DialContext: it
+// resolves the host portion of addr via the bootstrap servers and dials
+// the result directly, leaving addr (and therefore SNI/Host) alone.
+func (b *bootstrapResolver) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("doh: bootstrap: invalid address %s: %w", addr, err)
+	}
+
+	dialer := &net.Dialer{Timeout: 3 * time.Second}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	ips, err := b.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	return nil, fmt.Errorf("doh: bootstrap: failed to dial any resolved address for %s: %w", host, lastErr)
+}
+
+// resolve returns the cached IPs for host, refreshing them against the
+// bootstrap servers if the cache entry is missing or has expired.
+func (b *bootstrapResolver) resolve(host string) ([]net.IP, error) {
+	b.mu.RLock()
+	entry, cached := b.cache[host]
+	b.mu.RUnlock()
+	if cached && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	var lastErr error
+	for _, server := range b.addrs {
+		ips, ttl, err := lookupHost(server, host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		b.mu.Lock()
+		b.cache[host] = bootstrapEntry{ips: ips, expires: time.Now().Add(ttl)}
+		b.mu.Unlock()
+
+		return ips, nil
+	}
+
+	if cached {
+		// Every bootstrap server failed (or timed out); keep serving the
+		// stale entry rather than breaking an otherwise-working client.
+		return entry.ips, nil
+	}
+
+	return nil, fmt.Errorf("doh: bootstrap: failed to resolve %s: %w", host, lastErr)
+}
+
+// lookupHost queries server for both the A and AAAA records of host,
+// returning the combined addresses and the lowest TTL among them, each
+// TTL first raised to at least bootstrapMinTTL.
+func lookupHost(server, host string) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	minTTL := bootstrapMinTTL
+	haveTTL := false
+	var lastErr error
+
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		msg, err := queryBootstrap(server, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for _, a := range msg.Answers {
+			var ip net.IP
+			switch r := a.Body.(type) {
+			case *dnsmessage.AResource:
+				ip = net.IP(r.A[:])
+			case *dnsmessage.AAAAResource:
+				ip = net.IP(r.AAAA[:])
+			default:
+				continue
+			}
+
+			ips = append(ips, ip)
+			ttl := time.Duration(a.Header.TTL) * time.Second
+			if ttl < bootstrapMinTTL {
+				ttl = bootstrapMinTTL
+			}
+			if !haveTTL || ttl < minTTL {
+				minTTL = ttl
+				haveTTL = true
+			}
+		}
+	}
+
+	if len(ips) == 0 {
+		if lastErr != nil {
+			return nil, 0, lastErr
+		}
+		return nil, 0, fmt.Errorf("doh: bootstrap: %s returned no A/AAAA records for %s", server, host)
+	}
+
+	return ips, minTTL, nil
+}
+
+// queryBootstrap sends a single plain-DNS query for host to server over
+// UDP, retrying over TCP if the UDP answer was truncated.
+func queryBootstrap(server, host string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	name := host
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, fmt.Errorf("doh: bootstrap: invalid hostname %q: %w", host, err)
+	}
+
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, fmt.Errorf("doh: bootstrap: failed to generate query id: %w", err)
+	}
+
+	req := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               binary.BigEndian.Uint16(id[:]),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{
+			{Name: qname, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("doh: bootstrap: failed to pack query: %w", err)
+	}
+
+	addr := bootstrapAddr(server)
+
+	data, err := exchangeUDP(addr, packed)
+	if err != nil {
+		return nil, err
+	}
+
+	var rsp dnsmessage.Message
+	if err := rsp.Unpack(data); err != nil {
+		return nil, fmt.Errorf("doh: bootstrap: failed to unpack response from %s: %w", addr, err)
+	}
+	if err := validateBootstrapResponse(&req, &rsp); err != nil {
+		return nil, fmt.Errorf("doh: bootstrap: %s: %w", addr, err)
+	}
+
+	if rsp.Truncated {
+		if data, err = exchangeTCP(addr, packed); err != nil {
+			return nil, err
+		}
+		if err := rsp.Unpack(data); err != nil {
+			return nil, fmt.Errorf("doh: bootstrap: failed to unpack tcp response from %s: %w", addr, err)
+		}
+		if err := validateBootstrapResponse(&req, &rsp); err != nil {
+			return nil, fmt.Errorf("doh: bootstrap: %s: %w", addr, err)
+		}
+	}
+
+	return &rsp, nil
+}
+
+// validateBootstrapResponse checks that rsp is actually an answer to req:
+// its transaction ID matches and its question section echoes what was
+// asked. Bootstrap responses dictate where real DoH traffic gets dialed
+// (see dialContext), so an unvalidated response could be used to redirect
+// that traffic.
+func validateBootstrapResponse(req, rsp *dnsmessage.Message) error {
+	if rsp.ID != req.ID {
+		return fmt.Errorf("response id %d does not match query id %d", rsp.ID, req.ID)
+	}
+
+	if len(rsp.Questions) != len(req.Questions) {
+		return fmt.Errorf("response has %d questions, expected %d", len(rsp.Questions), len(req.Questions))
+	}
+	for i, q := range req.Questions {
+		rq := rsp.Questions[i]
+		if rq.Type != q.Type || rq.Class != q.Class || !strings.EqualFold(rq.Name.String(), q.Name.String()) {
+			return fmt.Errorf("response question %s does not match query %s", rq.Name.String(), q.Name.String())
+		}
+	}
+
+	return nil
+}
+
+// bootstrapAddr appends the default DNS port to server if it has none.
+func bootstrapAddr(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, "53")
+}
+
+func exchangeUDP(addr string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", addr, bootstrapTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("doh: bootstrap: failed to dial %s: %w", addr, err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetDeadline(time.Now().Add(bootstrapTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("doh: bootstrap: failed to send query to %s: %w", addr, err)
+	}
+
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("doh: bootstrap: failed to read response from %s: %w", addr, err)
+	}
+
+	return buf[:n], nil
+}
+
+func exchangeTCP(addr string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", addr, bootstrapTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("doh: bootstrap: failed to dial %s: %w", addr, err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetDeadline(time.Now().Add(bootstrapTimeout))
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(query)))
+	if _, err := conn.Write(append(length, query...)); err != nil {
+		return nil, fmt.Errorf("doh: bootstrap: failed to send query to %s: %w", addr, err)
+	}
+
+	var respLen uint16
+	if err := binary.Read(conn, binary.BigEndian, &respLen); err != nil {
+		return nil, fmt.Errorf("doh: bootstrap: failed to read response length from %s: %w", addr, err)
+	}
+
+	buf := make([]byte, respLen)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, fmt.Errorf("doh: bootstrap: failed to read response from %s: %w", addr, err)
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,136 @@
+package doh
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func buildTestQuery(t *testing.T, id uint16, name string, qtype dnsmessage.Type) dnsmessage.Message {
+	t.Helper()
+
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		t.Fatalf("failed to build test name: %v", err)
+	}
+	return dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+}
+
+func TestValidateBootstrapResponseOK(t *testing.T) {
+	req := buildTestQuery(t, 42, "example.com.", dnsmessage.TypeA)
+	rsp := buildTestQuery(t, 42, "example.com.", dnsmessage.TypeA)
+
+	if err := validateBootstrapResponse(&req, &rsp); err != nil {
+		t.Errorf("expected a matching response to validate, got: %v", err)
+	}
+}
+
+func TestValidateBootstrapResponseIDMismatch(t *testing.T) {
+	req := buildTestQuery(t, 42, "example.com.", dnsmessage.TypeA)
+	rsp := buildTestQuery(t, 43, "example.com.", dnsmessage.TypeA)
+
+	if err := validateBootstrapResponse(&req, &rsp); err == nil {
+		t.Error("expected a transaction ID mismatch to fail validation")
+	}
+}
+
+func TestValidateBootstrapResponseQuestionMismatch(t *testing.T) {
+	req := buildTestQuery(t, 42, "example.com.", dnsmessage.TypeA)
+	rsp := buildTestQuery(t, 42, "not-example.com.", dnsmessage.TypeA)
+
+	if err := validateBootstrapResponse(&req, &rsp); err == nil {
+		t.Error("expected a question-name mismatch to fail validation")
+	}
+}
+
+func TestValidateBootstrapResponseCaseInsensitive(t *testing.T) {
+	req := buildTestQuery(t, 42, "Example.COM.", dnsmessage.TypeA)
+	rsp := buildTestQuery(t, 42, "example.com.", dnsmessage.TypeA)
+
+	if err := validateBootstrapResponse(&req, &rsp); err != nil {
+		t.Errorf("expected DNS name comparison to be case-insensitive, got: %v", err)
+	}
+}
+
+// startFakeBootstrapServer starts a local UDP DNS server that answers
+// every A/AAAA query with a single record of ttlSecs, and returns its
+// "host:port" address. It stops when t's cleanup runs.
+func startFakeBootstrapServer(t *testing.T, ttlSecs uint32) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake bootstrap server: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, raddr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var req dnsmessage.Message
+			if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) != 1 {
+				continue
+			}
+			q := req.Questions[0]
+
+			rsp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: req.ID, Response: true},
+				Questions: req.Questions,
+			}
+			switch q.Type {
+			case dnsmessage.TypeA:
+				rsp.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttlSecs},
+					Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+				}}
+			case dnsmessage.TypeAAAA:
+				rsp.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: ttlSecs},
+					Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+				}}
+			}
+
+			packed, err := rsp.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(packed, raddr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestLookupHostClampsLowTTLToFloor(t *testing.T) {
+	addr := startFakeBootstrapServer(t, 1)
+
+	_, ttl, err := lookupHost(addr, "example.com")
+	if err != nil {
+		t.Fatalf("lookupHost returned an unexpected error: %v", err)
+	}
+	if ttl != bootstrapMinTTL {
+		t.Errorf("expected a 1s record TTL to be clamped to the %s floor, got %s", bootstrapMinTTL, ttl)
+	}
+}
+
+func TestLookupHostKeepsTTLAboveFloor(t *testing.T) {
+	addr := startFakeBootstrapServer(t, 300)
+
+	_, ttl, err := lookupHost(addr, "example.com")
+	if err != nil {
+		t.Fatalf("lookupHost returned an unexpected error: %v", err)
+	}
+	if ttl != 300*time.Second {
+		t.Errorf("expected the record's own 300s TTL to be kept, got %s", ttl)
+	}
+}
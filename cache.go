@@ -2,52 +2,126 @@
 package doh
 
 import (
+	"container/list"
 	"sync"
 	"time"
 )
 
-// cache is a basic, thread-safe in-memory cache with TTL support.
+// defaultCacheMaxEntries and defaultCacheMaxBytes bound the cache when
+// WithCacheSize has not been used to override them.
+const (
+	defaultCacheMaxEntries = 10000
+	defaultCacheMaxBytes   = 32 << 20 // 32 MiB
+)
+
+// cache is a bounded, thread-safe in-memory LRU cache with per-entry TTL.
+// Entries are evicted, oldest-used first, once either maxEntries or
+// maxBytes is exceeded.
 type cache struct {
-	sync.RWMutex
-	items map[string]cacheItem
+	mu sync.Mutex
+
+	maxEntries int
+	maxBytes   int64
+	curBytes   int64
+
+	ll    *list.List
+	items map[string]*list.Element
 }
 
-// cacheItem holds the value and expiration time for a cache entry.
-type cacheItem struct {
-	value      interface{}
-	expiration int64
+// cacheEntry is the value stored in cache.ll; it carries enough bookkeeping
+// to evict by size, expire by TTL and decrement a served TTL by age.
+type cacheEntry struct {
+	key       string
+	value     interface{}
+	size      int64
+	storedAt  time.Time
+	expiresAt time.Time
 }
 
-// newCache creates and returns a new instance of a cache.
-func newCache() *cache {
+// newCache creates a bounded LRU cache. maxEntries or maxBytes <= 0 falls
+// back to the package defaults rather than disabling the bound, so a
+// misconfigured client can't grow unbounded.
+func newCache(maxEntries int, maxBytes int64) *cache {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheMaxEntries
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultCacheMaxBytes
+	}
 	return &cache{
-		items: make(map[string]cacheItem),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
 	}
 }
 
-// Get retrieves an item from the cache. It returns nil if the item is not found
-// or has expired.
-func (c *cache) Get(key string) interface{} {
-	c.RLock()
-	defer c.RUnlock()
-	item, found := c.items[key]
-	if !found || time.Now().UnixNano() > item.expiration {
-		return nil
+// Get retrieves an item from the cache, promoting it to most-recently
+// used, along with age: how long it has sat in the cache. It returns ok
+// == false if the item is absent or has expired.
+func (c *cache) Get(key string) (value interface{}, age time.Duration, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.items[key]
+	if !found {
+		return nil, 0, false
+	}
+
+	entry := el.Value.(*cacheEntry)
+	now := time.Now()
+	if now.After(entry.expiresAt) {
+		c.removeElement(el)
+		return nil, 0, false
 	}
-	return item.value
+
+	c.ll.MoveToFront(el)
+	return entry.value, now.Sub(entry.storedAt), true
+}
+
+// Set adds or updates an item with the given approximate byte size
+// (counted against maxBytes) and TTL.
+func (c *cache) Set(key string, value interface{}, size int64, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		c.curBytes += size - entry.size
+		entry.value = value
+		entry.size = size
+		entry.storedAt = now
+		entry.expiresAt = now.Add(ttl)
+		c.ll.MoveToFront(el)
+	} else {
+		entry := &cacheEntry{key: key, value: value, size: size, storedAt: now, expiresAt: now.Add(ttl)}
+		c.items[key] = c.ll.PushFront(entry)
+		c.curBytes += size
+	}
+
+	c.evict()
 }
 
-// Set adds or updates an item in the cache with a specified TTL in seconds.
-func (c *cache) Set(key string, value interface{}, ttl int64) {
-	c.Lock()
-	defer c.Unlock()
-	expiration := time.Now().UnixNano() + (ttl * int64(time.Second))
-	c.items[key] = cacheItem{
-		value:      value,
-		expiration: expiration,
+// evict removes the least-recently-used entries until both bounds are
+// satisfied.
+func (c *cache) evict() {
+	for c.ll.Len() > c.maxEntries || c.curBytes > c.maxBytes {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.removeElement(oldest)
 	}
 }
 
+func (c *cache) removeElement(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	delete(c.items, entry.key)
+	c.curBytes -= entry.size
+	c.ll.Remove(el)
+}
+
 // Close is a no-op for the in-memory cache but is included for
 // potential future compatibility with more complex cache implementations.
 func (c *cache) Close() {
@@ -0,0 +1,91 @@
+package doh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheGetSetExpiry(t *testing.T) {
+	c := newCache(0, 0)
+
+	c.Set("a", "hello", 5, 50*time.Millisecond)
+
+	v, age, ok := c.Get("a")
+	if !ok {
+		t.Fatal("expected a cache hit right after Set")
+	}
+	if v.(string) != "hello" {
+		t.Errorf("expected value %q, got %q", "hello", v)
+	}
+	if age < 0 {
+		t.Errorf("expected non-negative age, got %s", age)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, _, ok := c.Get("a"); ok {
+		t.Error("expected the entry to have expired")
+	}
+}
+
+func TestCacheEvictsByMaxEntries(t *testing.T) {
+	c := newCache(2, 0)
+
+	c.Set("a", 1, 1, time.Minute)
+	c.Set("b", 2, 1, time.Minute)
+	c.Set("c", 2, 1, time.Minute) // evicts "a", the least recently used
+
+	if _, _, ok := c.Get("a"); ok {
+		t.Error("expected \"a\" to have been evicted")
+	}
+	if _, _, ok := c.Get("b"); !ok {
+		t.Error("expected \"b\" to still be cached")
+	}
+	if _, _, ok := c.Get("c"); !ok {
+		t.Error("expected \"c\" to still be cached")
+	}
+}
+
+func TestCacheEvictsByMaxBytes(t *testing.T) {
+	c := newCache(0, 10)
+
+	c.Set("a", 1, 6, time.Minute)
+	c.Set("b", 2, 6, time.Minute) // total would be 12 > 10, evicts "a"
+
+	if _, _, ok := c.Get("a"); ok {
+		t.Error("expected \"a\" to have been evicted to stay under maxBytes")
+	}
+	if _, _, ok := c.Get("b"); !ok {
+		t.Error("expected \"b\" to still be cached")
+	}
+}
+
+func TestCacheGetPromotesToFront(t *testing.T) {
+	c := newCache(2, 0)
+
+	c.Set("a", 1, 1, time.Minute)
+	c.Set("b", 2, 1, time.Minute)
+	c.Get("a")                     // "a" is now most-recently used
+	c.Set("c", 3, 1, time.Minute) // should evict "b", not "a"
+
+	if _, _, ok := c.Get("a"); !ok {
+		t.Error("expected \"a\" to still be cached after being promoted by Get")
+	}
+	if _, _, ok := c.Get("b"); ok {
+		t.Error("expected \"b\" to have been evicted")
+	}
+}
+
+func TestCacheSetOverwritesExisting(t *testing.T) {
+	c := newCache(0, 0)
+
+	c.Set("a", 1, 1, time.Minute)
+	c.Set("a", 2, 1, time.Minute)
+
+	v, _, ok := c.Get("a")
+	if !ok {
+		t.Fatal("expected a cache hit")
+	}
+	if v.(int) != 2 {
+		t.Errorf("expected the overwritten value 2, got %v", v)
+	}
+}
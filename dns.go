@@ -31,17 +31,25 @@ type Answer struct {
 
 // Response is dns query response
 type Response struct {
-	Status   int        `json:"Status"`
-	TC       bool       `json:"TC"`
-	RD       bool       `json:"RD"`
-	RA       bool       `json:"RA"`
-	AD       bool       `json:"AD"`
-	CD       bool       `json:"CD"`
-	Question []Question `json:"Question"`
-	Answer   []Answer   `json:"Answer"`
-	Provider string     `json:"provider"`
+	Status    int        `json:"Status"`
+	TC        bool       `json:"TC"`
+	RD        bool       `json:"RD"`
+	RA        bool       `json:"RA"`
+	AD        bool       `json:"AD"`
+	CD        bool       `json:"CD"`
+	Question  []Question `json:"Question"`
+	Answer    []Answer   `json:"Answer"`
+	// Authority holds the records returned in the authority section, e.g.
+	// the SOA record servers send alongside an NXDOMAIN or empty answer,
+	// used for negative caching (see negativeTTL).
+	Authority []Answer `json:"Authority"`
+	Provider  string   `json:"provider"`
 }
 
+// statusNXDomain is the RCODE value for a non-existent domain (RFC 1035
+// section 4.1.1).
+const statusNXDomain = 3
+
 // Supported dns query type
 var (
 	TypeA     = Type("A")
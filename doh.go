@@ -3,8 +3,6 @@ package doh
 
 import (
 	"context"
-	"crypto/sha1"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -21,11 +19,20 @@ type Option func(*DoH)
 
 // DoH is a DNS-over-HTTPS client.
 type DoH struct {
-	urls       []string
-	cache      *cache
-	stats      map[int][]interface{}
-	stopc      chan bool
-	httpClient *http.Client
+	urls             []string
+	transports       map[int]Transport
+	wireFormat       bool
+	truncationPolicy TruncationPolicy
+	bootstrap        *bootstrapResolver
+	cache            *cache
+	cacheMaxEntries  int
+	cacheMaxBytes    int64
+	cacheMinTTL      time.Duration
+	cacheMaxTTL      time.Duration
+	stats            map[int]*providerStat
+	raceHeadStart    time.Duration
+	raceMaxParallel  int
+	httpClient       *http.Client
 	sync.RWMutex
 }
 
@@ -97,9 +104,9 @@ func New(opts ...Option) *DoH {
 
 	c := &DoH{
 		urls:       nil, // Will be set by WithProviders or default
+		transports: make(map[int]Transport),
 		cache:      nil,
-		stats:      make(map[int][]interface{}),
-		stopc:      make(chan bool),
+		stats:      make(map[int]*providerStat),
 		httpClient: defaultClient,
 	}
 
@@ -118,30 +125,14 @@ func New(opts ...Option) *DoH {
 		}
 	}
 
-	go func() {
-		t := time.NewTicker(5 * time.Second)
-		defer t.Stop()
-		for {
-			select {
-			case <-c.stopc:
-				return
-			case <-t.C:
-				c.Lock()
-				for k := range c.stats {
-					delete(c.stats, k)
-				}
-				c.Unlock()
-			}
-		}
-	}()
-
 	return c
 }
 
-// EnableCache enable query cache
+// EnableCache enable query cache. Its size is bounded by WithCacheSize
+// (or the package defaults, if that option wasn't used).
 func (c *DoH) EnableCache(cache bool) *DoH {
 	if cache {
-		c.cache = newCache()
+		c.cache = newCache(c.cacheMaxEntries, c.cacheMaxBytes)
 	} else {
 		c.cache = nil
 	}
@@ -150,61 +141,59 @@ func (c *DoH) EnableCache(cache bool) *DoH {
 
 // Close close doh client
 func (c *DoH) Close() {
-	c.stopc <- true
 	if c.cache != nil {
 		c.cache.Close()
 	}
+	if c.bootstrap != nil {
+		c.bootstrap.Close()
+	}
 }
 
 // Query do DoH query
 func (c *DoH) Query(ctx context.Context, d Domain, t Type, s ...ECS) (*Response, error) {
-	urlsToQuery := make(map[int]string)
-
-	c.RLock()
-	if len(c.stats) > 0 {
-		minIndex := -1
-		minRate := 101.0
-		for k, v := range c.stats {
-			rate := v[2].(float64)
-			if rate < minRate {
-				minRate = rate
-				minIndex = k
-			}
-		}
-		if minIndex != -1 {
-			urlsToQuery[minIndex] = c.urls[minIndex]
-		}
-	}
-
-	if len(urlsToQuery) == 0 {
-		for i, u := range c.urls {
-			urlsToQuery[i] = u
-		}
-	}
-	c.RUnlock()
-
-	return c.fastQuery(ctx, urlsToQuery, d, t, s...)
+	return c.fastQuery(ctx, d, t, s...)
 }
 
-// fastQuery do query and returns the fastest result
-func (c *DoH) fastQuery(ctx context.Context,
-	urls map[int]string, d Domain, t Type, s ...ECS) (*Response, error) {
+// fastQuery races providers ordered by their current latency/error-rate
+// score (see orderedProviders): the top-ranked provider is dispatched
+// immediately, and each subsequent one only after a head-start delay
+// (see headStartAfter) unless a response has already won the race.
+func (c *DoH) fastQuery(ctx context.Context, d Domain, t Type, s ...ECS) (*Response, error) {
 	if c.cache != nil {
 		if resp, ok := c.checkCache(d, t, s...); ok {
 			return resp, nil
 		}
 	}
 
-	ctxs, cancels := context.WithCancel(ctx)
-	defer cancels()
+	ctxs, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	r := make(chan interface{})
-	for originalIndex, u := range urls {
-		go c.goQuery(ctxs, originalIndex, u, d, t, r, s...)
+	order := c.orderedProviders()
+	if max := c.raceMaxParallel; max > 0 && max < len(order) {
+		order = order[:max]
 	}
 
-	resp, err := c.collectResponses(r, len(urls))
-	if err == nil && c.cache != nil {
+	r := make(chan interface{}, len(order))
+	urls := c.urls
+	go c.goQuery(ctxs, order[0], urls[order[0]], d, t, r, s...)
+
+	go func() {
+		prev := order[0]
+		for _, idx := range order[1:] {
+			timer := time.NewTimer(c.headStartAfter(prev))
+			select {
+			case <-ctxs.Done():
+				timer.Stop()
+				r <- goResult{err: ctxs.Err()}
+			case <-timer.C:
+				go c.goQuery(ctxs, idx, urls[idx], d, t, r, s...)
+			}
+			prev = idx
+		}
+	}()
+
+	resp, err := c.collectResponses(r, len(order))
+	if c.cache != nil && resp != nil && (err == nil || resp.Status == statusNXDomain || (resp.Status == 0 && len(resp.Answer) == 0)) {
 		c.updateCache(d, t, resp, s...)
 	}
 
@@ -212,50 +201,48 @@ func (c *DoH) fastQuery(ctx context.Context,
 }
 
 func (c *DoH) checkCache(d Domain, t Type, s ...ECS) (*Response, bool) {
-	var ss string
-	if len(s) > 0 && s[0] != "" {
-		ss = strings.TrimSpace(string(s[0]))
-	}
-	hasher := sha1.New()
-	hasher.Write([]byte(string(d) + string(t) + ss))
-	cacheKey := hex.EncodeToString(hasher.Sum(nil))
-	v := c.cache.Get(cacheKey)
-	if v != nil {
-		return v.(*Response), true
+	v, age, ok := c.cache.Get(cacheKey(d, t, s...))
+	if !ok {
+		return nil, false
 	}
-	return nil, false
+	return decrementTTL(v.(*Response), age), true
 }
 
-func (c *DoH) goQuery(ctx context.Context, k int, u string, d Domain, t Type, r chan<- interface{}, s ...ECS) {
-	rsp, err := c.query(ctx, u, d, t, s...)
-	c.Lock()
-	if _, ok := c.stats[k]; !ok {
-		c.stats[k] = []interface{}{0, 0, 100.0}
-	}
-	c.stats[k][1] = c.stats[k][1].(int) + 1
-	if err != nil {
-		c.stats[k][0] = c.stats[k][0].(int) + 1
-	}
-	c.stats[k][2] = float64(c.stats[k][0].(int)) / float64(c.stats[k][1].(int)) * 100
-	c.Unlock()
+// goResult bundles a provider's response and error. Keeping both together
+// (rather than sending one or the other) lets collectResponses hand a
+// negative answer, e.g. NXDOMAIN, back to fastQuery for caching even
+// though the query ultimately fails.
+type goResult struct {
+	resp *Response
+	err  error
+}
 
-	if err == nil {
-		r <- rsp
-	} else {
-		r <- err
-	}
+func (c *DoH) goQuery(ctx context.Context, k int, u string, d Domain, t Type, r chan<- interface{}, s ...ECS) {
+	start := time.Now()
+	rsp, err := c.query(ctx, k, u, d, t, s...)
+	c.recordStat(k, time.Since(start), err)
+	r <- goResult{resp: rsp, err: err}
 }
 
+// collectResponses reads from r until a provider succeeds or totalUrls
+// results have come in. On failure, it also returns the first response
+// that came with an error (e.g. a well-formed NXDOMAIN), if any, so the
+// caller can still negatively cache it.
 func (c *DoH) collectResponses(r chan interface{}, totalUrls int) (*Response, error) {
 	var firstError error
+	var failedResp *Response
 	total := 0
 	for v := range r {
 		total++
-		if resp, ok := v.(*Response); ok {
-			return resp, nil
-		} else if err, ok := v.(error); ok {
+		if res, ok := v.(goResult); ok {
+			if res.err == nil {
+				return res.resp, nil
+			}
 			if firstError == nil {
-				firstError = err
+				firstError = res.err
+			}
+			if failedResp == nil {
+				failedResp = res.resp
 			}
 		}
 
@@ -265,29 +252,39 @@ func (c *DoH) collectResponses(r chan interface{}, totalUrls int) (*Response, er
 	}
 
 	if firstError != nil {
-		return nil, firstError
+		return failedResp, firstError
 	}
 
 	return nil, fmt.Errorf("doh: all %d providers failed to respond", totalUrls)
 }
 
+// updateCache stores resp for (d, t, s), including negative (NXDOMAIN or
+// empty-answer) results per RFC 2308, with its TTL clamped by
+// WithCacheMinTTL/WithCacheMaxTTL.
 func (c *DoH) updateCache(d Domain, t Type, resp *Response, s ...ECS) {
-	var ss string
-	if len(s) > 0 && s[0] != "" {
-		ss = strings.TrimSpace(string(s[0]))
-	}
-	hasher := sha1.New()
-	hasher.Write([]byte(string(d) + string(t) + ss))
-	cacheKey := hex.EncodeToString(hasher.Sum(nil))
-	ttl := 30
-	if len(resp.Answer) > 0 {
-		ttl = resp.Answer[0].TTL
+	ttl := c.clampTTL(cacheTTL(resp))
+	c.cache.Set(cacheKey(d, t, s...), resp, cacheEntrySize(resp), ttl)
+}
+
+// query builds and executes a DoH query, using the transport configured
+// for provider idx, and applies c.truncationPolicy if the answer comes
+// back truncated.
+func (c *DoH) query(ctx context.Context, idx int, u string, d Domain, t Type, s ...ECS) (*Response, error) {
+	rsp, err := c.queryOnce(ctx, idx, u, d, t, s...)
+	if err != nil || !rsp.TC {
+		return rsp, err
 	}
-	c.cache.Set(cacheKey, resp, int64(ttl))
+
+	return c.handleTruncated(ctx, idx, u, d, t, rsp, s...)
 }
 
-// query builds and executes a DoH query.
-func (c *DoH) query(ctx context.Context, u string, d Domain, t Type, s ...ECS) (*Response, error) {
+// queryOnce builds and executes a single DoH query, using the transport
+// configured for provider idx, without any truncation handling.
+func (c *DoH) queryOnce(ctx context.Context, idx int, u string, d Domain, t Type, s ...ECS) (*Response, error) {
+	if c.transportFor(idx, u) == TransportWire {
+		return c.queryWire(ctx, u, d, t, s...)
+	}
+
 	req, err := c.buildRequest(ctx, u, d, t, s...)
 	if err != nil {
 		return nil, err
@@ -82,8 +82,8 @@ func TestEnableCache(t *testing.T) {
 	if len(rsp.Answer) == 0 {
 		t.Fatal("Expected at least one answer from cache, got 0")
 	}
-	if rsp.Answer[0].TTL != ttl {
-		t.Errorf("Expected TTL from cache to be %d, but got %d", ttl, rsp.Answer[0].TTL)
+	if rsp.Answer[0].TTL >= ttl {
+		t.Errorf("Expected TTL from cache to have decreased from %d after 1s, but got %d", ttl, rsp.Answer[0].TTL)
 	}
 
 	c.EnableCache(false)
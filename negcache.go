@@ -0,0 +1,248 @@
+package doh
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// defaultCacheTTL is used when a response carries no usable TTL of its
+// own (e.g. a malformed SOA record in the authority section).
+const defaultCacheTTL = 30 * time.Second
+
+// WithCacheSize bounds the query cache enabled by EnableCache: maxEntries
+// caps the number of cached responses, maxBytes caps their approximate
+// combined size. Either <= 0 falls back to a package default. It has no
+// effect unless EnableCache is also called.
+func WithCacheSize(maxEntries int, maxBytes int64) Option {
+	return func(d *DoH) {
+		d.cacheMaxEntries = maxEntries
+		d.cacheMaxBytes = maxBytes
+	}
+}
+
+// WithCacheMinTTL clamps every cached entry's TTL to at least min,
+// overriding short upstream TTLs that would otherwise cause excessive
+// re-querying. 0 (the default) applies no minimum.
+func WithCacheMinTTL(min time.Duration) Option {
+	return func(d *DoH) {
+		d.cacheMinTTL = min
+	}
+}
+
+// WithCacheMaxTTL clamps every cached entry's TTL to at most max. 0 (the
+// default) applies no maximum.
+func WithCacheMaxTTL(max time.Duration) Option {
+	return func(d *DoH) {
+		d.cacheMaxTTL = max
+	}
+}
+
+// clampTTL applies the client's configured cache TTL bounds to ttl.
+func (c *DoH) clampTTL(ttl time.Duration) time.Duration {
+	if c.cacheMinTTL > 0 && ttl < c.cacheMinTTL {
+		ttl = c.cacheMinTTL
+	}
+	if c.cacheMaxTTL > 0 && ttl > c.cacheMaxTTL {
+		ttl = c.cacheMaxTTL
+	}
+	return ttl
+}
+
+// cacheKey derives the cache key for a Query, case-folding the domain so
+// that "Example.com" and "example.com" share an entry.
+func cacheKey(d Domain, t Type, s ...ECS) string {
+	return namespacedCacheKey("resp", d, t, s...)
+}
+
+// messageCacheKey derives the cache key for a QueryMessage. It is
+// namespaced separately from cacheKey so a *dnsmessage.Message cached by
+// QueryMessage can never collide with, and be mistaken for, a *Response
+// cached by Query for the same (domain, type, ecs).
+func messageCacheKey(d Domain, t Type, s ...ECS) string {
+	return namespacedCacheKey("msg", d, t, s...)
+}
+
+func namespacedCacheKey(ns string, d Domain, t Type, s ...ECS) string {
+	var ss string
+	if len(s) > 0 && s[0] != "" {
+		ss = strings.TrimSpace(string(s[0]))
+	}
+	name := strings.ToLower(strings.TrimSpace(string(d)))
+
+	hasher := sha1.New()
+	hasher.Write([]byte(ns + ":" + name + string(t) + ss))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// cacheTTL returns how long resp should be cached for: the lowest TTL
+// among its answer records for a positive response, or the negative-cache
+// TTL derived from its authority section (RFC 2308) when the answer
+// section is empty or the status is NXDOMAIN.
+func cacheTTL(resp *Response) time.Duration {
+	if resp.Status == statusNXDomain || len(resp.Answer) == 0 {
+		if ttl, ok := negativeTTL(resp); ok {
+			return ttl
+		}
+		return defaultCacheTTL
+	}
+
+	ttl := resp.Answer[0].TTL
+	for _, a := range resp.Answer[1:] {
+		if a.TTL < ttl {
+			ttl = a.TTL
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// dnsRRTypeSOA is the RR type number for an SOA record (RFC 1035 section
+// 3.3.13).
+const dnsRRTypeSOA = 6
+
+// negativeTTL extracts the negative-caching TTL for resp per RFC 2308
+// section 5: the minimum of the SOA record's own TTL and its MINIMUM
+// field, read from the authority section.
+func negativeTTL(resp *Response) (time.Duration, bool) {
+	for _, a := range resp.Authority {
+		if a.Type != dnsRRTypeSOA {
+			continue
+		}
+
+		fields := strings.Fields(a.Data)
+		if len(fields) < 7 {
+			continue
+		}
+		minimum, err := strconv.ParseUint(fields[6], 10, 32)
+		if err != nil {
+			continue
+		}
+
+		ttl := time.Duration(a.TTL) * time.Second
+		if soaMin := time.Duration(minimum) * time.Second; soaMin < ttl {
+			ttl = soaMin
+		}
+		return ttl, true
+	}
+	return 0, false
+}
+
+// cacheEntrySize estimates resp's footprint in bytes, for weighing against
+// WithCacheSize's maxBytes bound.
+func cacheEntrySize(resp *Response) int64 {
+	const overhead = 64
+	size := int64(overhead)
+	for _, a := range resp.Answer {
+		size += int64(len(a.Name) + len(a.Data) + overhead)
+	}
+	for _, a := range resp.Authority {
+		size += int64(len(a.Name) + len(a.Data) + overhead)
+	}
+	return size
+}
+
+// decrementTTL returns a copy of resp with every TTL reduced by age, so a
+// response served from the cache reports how much longer it is actually
+// valid for rather than its original, now-stale, TTL.
+func decrementTTL(resp *Response, age time.Duration) *Response {
+	ageSecs := int(age.Seconds())
+
+	out := *resp
+	out.Answer = decrementAnswerTTLs(resp.Answer, ageSecs)
+	out.Authority = decrementAnswerTTLs(resp.Authority, ageSecs)
+	return &out
+}
+
+func decrementAnswerTTLs(answers []Answer, ageSecs int) []Answer {
+	if answers == nil {
+		return nil
+	}
+
+	out := make([]Answer, len(answers))
+	for i, a := range answers {
+		a.TTL -= ageSecs
+		if a.TTL < 0 {
+			a.TTL = 0
+		}
+		out[i] = a
+	}
+	return out
+}
+
+// messageCacheTTL is cacheTTL's counterpart for QueryMessage's wire-format
+// path.
+func messageCacheTTL(msg *dnsmessage.Message) time.Duration {
+	if msg.RCode == dnsmessage.RCodeNameError || (msg.RCode == dnsmessage.RCodeSuccess && len(msg.Answers) == 0) {
+		if ttl, ok := negativeMessageTTL(msg); ok {
+			return ttl
+		}
+		return defaultCacheTTL
+	}
+
+	ttl := msg.Answers[0].Header.TTL
+	for _, a := range msg.Answers[1:] {
+		if a.Header.TTL < ttl {
+			ttl = a.Header.TTL
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// negativeMessageTTL is negativeTTL's counterpart for QueryMessage: since
+// the wire path keeps RDATA as typed Go structs, the SOA MINIMUM field can
+// be read directly instead of parsed out of a text blob.
+func negativeMessageTTL(msg *dnsmessage.Message) (time.Duration, bool) {
+	for _, a := range msg.Authorities {
+		soa, ok := a.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			continue
+		}
+
+		ttl := time.Duration(a.Header.TTL) * time.Second
+		if soaMin := time.Duration(soa.MinTTL) * time.Second; soaMin < ttl {
+			ttl = soaMin
+		}
+		return ttl, true
+	}
+	return 0, false
+}
+
+// messageCacheEntrySize is cacheEntrySize's counterpart for QueryMessage,
+// using the message's own packed wire size.
+func messageCacheEntrySize(msg *dnsmessage.Message) int64 {
+	if packed, err := msg.Pack(); err == nil {
+		return int64(len(packed))
+	}
+	return 512
+}
+
+// decrementMessageTTL is decrementTTL's counterpart for QueryMessage.
+func decrementMessageTTL(msg *dnsmessage.Message, age time.Duration) *dnsmessage.Message {
+	ageSecs := uint32(age.Seconds())
+
+	out := *msg
+	out.Answers = decrementResourceTTLs(msg.Answers, ageSecs)
+	out.Authorities = decrementResourceTTLs(msg.Authorities, ageSecs)
+	return &out
+}
+
+func decrementResourceTTLs(resources []dnsmessage.Resource, ageSecs uint32) []dnsmessage.Resource {
+	if resources == nil {
+		return nil
+	}
+
+	out := make([]dnsmessage.Resource, len(resources))
+	for i, r := range resources {
+		if r.Header.TTL > ageSecs {
+			r.Header.TTL -= ageSecs
+		} else {
+			r.Header.TTL = 0
+		}
+		out[i] = r
+	}
+	return out
+}
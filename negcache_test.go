@@ -0,0 +1,87 @@
+package doh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheKeyCaseFolding(t *testing.T) {
+	if cacheKey("Example.com", TypeA) != cacheKey("example.com", TypeA) {
+		t.Error("expected cacheKey to case-fold the domain")
+	}
+	if cacheKey("example.com", TypeA) == cacheKey("example.com", TypeAAAA) {
+		t.Error("expected cacheKey to differ by query type")
+	}
+}
+
+func TestCacheKeyMessageNamespace(t *testing.T) {
+	if cacheKey("example.com", TypeA) == messageCacheKey("example.com", TypeA) {
+		t.Error("expected cacheKey and messageCacheKey to never collide")
+	}
+}
+
+func TestCacheTTLPositive(t *testing.T) {
+	resp := &Response{
+		Answer: []Answer{
+			{TTL: 300},
+			{TTL: 60},
+			{TTL: 120},
+		},
+	}
+
+	if got := cacheTTL(resp); got != 60*time.Second {
+		t.Errorf("expected the lowest answer TTL (60s), got %s", got)
+	}
+}
+
+func TestCacheTTLNegativeNXDomain(t *testing.T) {
+	resp := &Response{
+		Status: statusNXDomain,
+		Authority: []Answer{
+			{Type: dnsRRTypeSOA, TTL: 3600, Data: "ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"},
+		},
+	}
+
+	if got := cacheTTL(resp); got != 300*time.Second {
+		t.Errorf("expected the SOA MINIMUM (300s), got %s", got)
+	}
+}
+
+func TestCacheTTLNegativeUsesLowerOfSOATTLAndMinimum(t *testing.T) {
+	resp := &Response{
+		Status: statusNXDomain,
+		Authority: []Answer{
+			{Type: dnsRRTypeSOA, TTL: 60, Data: "ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 1800"},
+		},
+	}
+
+	if got := cacheTTL(resp); got != 60*time.Second {
+		t.Errorf("expected min(SOA.TTL, SOA.MINIMUM) = 60s, got %s", got)
+	}
+}
+
+func TestCacheTTLNegativeFallsBackWithoutSOA(t *testing.T) {
+	resp := &Response{Status: statusNXDomain}
+
+	if got := cacheTTL(resp); got != defaultCacheTTL {
+		t.Errorf("expected the default negative-cache TTL, got %s", got)
+	}
+}
+
+func TestDecrementTTL(t *testing.T) {
+	resp := &Response{
+		Answer:    []Answer{{TTL: 100}},
+		Authority: []Answer{{TTL: 10}},
+	}
+
+	out := decrementTTL(resp, 30*time.Second)
+	if out.Answer[0].TTL != 70 {
+		t.Errorf("expected answer TTL 70, got %d", out.Answer[0].TTL)
+	}
+	if out.Authority[0].TTL != 0 {
+		t.Errorf("expected authority TTL clamped to 0, got %d", out.Authority[0].TTL)
+	}
+	if resp.Answer[0].TTL != 100 {
+		t.Error("decrementTTL must not mutate the cached Response in place")
+	}
+}
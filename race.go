@@ -0,0 +1,127 @@
+package doh
+
+import (
+	"sort"
+	"time"
+)
+
+// statAlpha is the EWMA smoothing factor applied to both latency and
+// error-rate samples in goQuery. ~0.1 means roughly the last ten queries
+// dominate a provider's score.
+const statAlpha = 0.1
+
+// defaultRaceHeadStart is the delay before racing the next provider when
+// WithRacePolicy has not set one explicitly.
+const defaultRaceHeadStart = 150 * time.Millisecond
+
+// providerStat tracks a provider's smoothed round-trip latency and error
+// rate, the inputs to its race-ordering score. Unlike the old stats map,
+// it is never reset: it accrues for the lifetime of the DoH client.
+type providerStat struct {
+	latency time.Duration // EWMA of round-trip latency
+	errRate float64       // EWMA of the error rate, in [0,1]
+	samples int
+}
+
+// score ranks providers for racing: lower is better. A non-trivial error
+// rate pushes a provider well behind reliable ones, even if it is
+// currently faster.
+func (s providerStat) score() float64 {
+	return float64(s.latency) * (1 + 9*s.errRate)
+}
+
+// WithRacePolicy configures how Query races providers against each other:
+// headStart is the delay before the next-ranked provider is dispatched
+// (capped by 2x its predecessor's observed latency, whichever is
+// smaller), and maxParallel caps how many providers a query is raced
+// against: only the top maxParallel ranked providers are tried, and the
+// rest are not tried even if all of those fail. maxParallel <= 0 means no
+// cap (race the whole pool if needed).
+func WithRacePolicy(headStart time.Duration, maxParallel int) Option {
+	return func(d *DoH) {
+		d.raceHeadStart = headStart
+		d.raceMaxParallel = maxParallel
+	}
+}
+
+// Stats returns a snapshot of each configured provider's current race
+// score (lower is better), keyed by its index in the provider list.
+func (c *DoH) Stats() map[int]float64 {
+	c.RLock()
+	defer c.RUnlock()
+
+	out := make(map[int]float64, len(c.stats))
+	for k, v := range c.stats {
+		out[k] = v.score()
+	}
+	return out
+}
+
+// orderedProviders returns every configured provider's index, sorted by
+// race score ascending. Providers without stats yet sort first (score 0)
+// so they get a chance to build up signal.
+func (c *DoH) orderedProviders() []int {
+	c.RLock()
+	defer c.RUnlock()
+
+	order := make([]int, len(c.urls))
+	scores := make([]float64, len(c.urls))
+	for i := range c.urls {
+		order[i] = i
+		if stat, ok := c.stats[i]; ok {
+			scores[i] = stat.score()
+		}
+	}
+
+	sort.SliceStable(order, func(a, b int) bool {
+		return scores[order[a]] < scores[order[b]]
+	})
+
+	return order
+}
+
+// headStartAfter returns how long to wait after dispatching provider
+// leaderIdx before racing the next-ranked provider.
+func (c *DoH) headStartAfter(leaderIdx int) time.Duration {
+	headStart := c.raceHeadStart
+	if headStart <= 0 {
+		headStart = defaultRaceHeadStart
+	}
+
+	c.RLock()
+	stat, ok := c.stats[leaderIdx]
+	c.RUnlock()
+
+	if ok && stat.samples > 0 {
+		if d := 2 * stat.latency; d < headStart {
+			return d
+		}
+	}
+	return headStart
+}
+
+// recordStat folds a query's latency and outcome into provider k's EWMA.
+func (c *DoH) recordStat(k int, latency time.Duration, err error) {
+	errSample := 0.0
+	if err != nil {
+		errSample = 1.0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	stat, ok := c.stats[k]
+	if !ok {
+		stat = &providerStat{}
+		c.stats[k] = stat
+	}
+
+	if stat.samples == 0 {
+		stat.latency = latency
+		stat.errRate = errSample
+	} else {
+		stat.latency = time.Duration((1-statAlpha)*float64(stat.latency) + statAlpha*float64(latency))
+		stat.errRate = (1-statAlpha)*stat.errRate + statAlpha*errSample
+	}
+	stat.samples++
+}
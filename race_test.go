@@ -0,0 +1,90 @@
+package doh
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newRaceTestClient() *DoH {
+	return New(WithProviders([]string{"a", "b", "c"}))
+}
+
+func TestOrderedProvidersUnscoredFirst(t *testing.T) {
+	c := newRaceTestClient()
+	defer c.Close()
+
+	c.recordStat(1, 100*time.Millisecond, nil)
+
+	order := c.orderedProviders()
+	if order[0] == 1 {
+		t.Errorf("expected an unscored provider to rank before a scored one, got order %v", order)
+	}
+}
+
+func TestOrderedProvidersRanksByLatency(t *testing.T) {
+	c := newRaceTestClient()
+	defer c.Close()
+
+	c.recordStat(0, 200*time.Millisecond, nil)
+	c.recordStat(1, 10*time.Millisecond, nil)
+	c.recordStat(2, 50*time.Millisecond, nil)
+
+	order := c.orderedProviders()
+	want := []int{1, 2, 0}
+	for i, idx := range want {
+		if order[i] != idx {
+			t.Fatalf("expected order %v, got %v", want, order)
+		}
+	}
+}
+
+func TestOrderedProvidersPenalizesErrors(t *testing.T) {
+	c := newRaceTestClient()
+	defer c.Close()
+
+	c.recordStat(0, 10*time.Millisecond, errors.New("boom"))
+	c.recordStat(1, 10*time.Millisecond, nil)
+	c.recordStat(2, 10*time.Millisecond, nil)
+
+	order := c.orderedProviders()
+	if order[0] != 1 && order[0] != 2 {
+		t.Errorf("expected an error-free provider to rank first, got order %v", order)
+	}
+	if order[2] != 0 {
+		t.Errorf("expected the erroring provider to rank last, got order %v", order)
+	}
+}
+
+func TestRecordStatEWMA(t *testing.T) {
+	c := newRaceTestClient()
+	defer c.Close()
+
+	c.recordStat(0, 100*time.Millisecond, nil)
+	c.recordStat(0, 100*time.Millisecond, nil)
+
+	stats := c.Stats()
+	if stats[0] <= 0 {
+		t.Errorf("expected a positive score after recording latency, got %v", stats[0])
+	}
+}
+
+func TestHeadStartAfterCapsAtObservedLatency(t *testing.T) {
+	c := newRaceTestClient()
+	defer c.Close()
+
+	c.recordStat(0, 10*time.Millisecond, nil)
+
+	if got := c.headStartAfter(0); got != 20*time.Millisecond {
+		t.Errorf("expected 2x the observed 10ms latency (20ms), got %s", got)
+	}
+}
+
+func TestHeadStartAfterDefaultsWithoutStats(t *testing.T) {
+	c := newRaceTestClient()
+	defer c.Close()
+
+	if got := c.headStartAfter(0); got != defaultRaceHeadStart {
+		t.Errorf("expected the default head start, got %s", got)
+	}
+}
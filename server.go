@@ -0,0 +1,376 @@
+package doh
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// defaultUDPBufferSize is the maximum response size assumed for a UDP
+// client that did not advertise a larger buffer via EDNS0 (RFC 1035
+// section 2.3.4).
+const defaultUDPBufferSize = 512
+
+// ServerOption is a function that configures a Server.
+type ServerOption func(*Server)
+
+// WithRefuseAny makes the server answer ANY queries with RCodeRefused
+// instead of forwarding them, mirroring the RFC 8482 recommendation that
+// resolvers stop answering ANY honestly.
+func WithRefuseAny(refuse bool) ServerOption {
+	return func(s *Server) {
+		s.refuseAny = refuse
+	}
+}
+
+// WithRateLimit caps the number of queries accepted per client IP to ratePerSecond,
+// with bursts up to burst queries, using a token bucket per client. A
+// ratePerSecond of 0 disables rate limiting (the default).
+func WithRateLimit(ratePerSecond float64, burst int) ServerOption {
+	return func(s *Server) {
+		if ratePerSecond <= 0 {
+			s.limiter = nil
+			return
+		}
+		s.limiter = newRateLimiter(ratePerSecond, burst)
+	}
+}
+
+// Server is a local UDP/TCP DNS server that forwards every query it
+// receives through a *DoH client, turning the library into a drop-in stub
+// resolver for LANs and containers.
+type Server struct {
+	client    *DoH
+	addr      string
+	refuseAny bool
+	limiter   *rateLimiter
+
+	udpConn net.PacketConn
+	tcpLn   net.Listener
+
+	stopc     chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewServer returns a Server that forwards queries received on addr (e.g.
+// ":53" or "127.0.0.1:5353") through client.
+func NewServer(client *DoH, addr string, opts ...ServerOption) *Server {
+	s := &Server{
+		client: client,
+		addr:   addr,
+		stopc:  make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// ListenAndServe starts the UDP and TCP listeners and blocks until one of
+// them fails or Close is called.
+func (s *Server) ListenAndServe() error {
+	udpConn, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return fmt.Errorf("doh: server: failed to listen on udp %s: %w", s.addr, err)
+	}
+	s.udpConn = udpConn
+
+	tcpLn, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		_ = udpConn.Close()
+		return fmt.Errorf("doh: server: failed to listen on tcp %s: %w", s.addr, err)
+	}
+	s.tcpLn = tcpLn
+
+	errc := make(chan error, 2)
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		errc <- s.serveUDP()
+	}()
+	go func() {
+		defer s.wg.Done()
+		errc <- s.serveTCP()
+	}()
+
+	err = <-errc
+	s.Close()
+	return err
+}
+
+// Close shuts down the listeners and waits for in-flight requests to
+// finish.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stopc)
+		if s.udpConn != nil {
+			_ = s.udpConn.Close()
+		}
+		if s.tcpLn != nil {
+			_ = s.tcpLn.Close()
+		}
+	})
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) serveUDP() error {
+	buf := make([]byte, 65535)
+	for {
+		n, raddr, err := s.udpConn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.stopc:
+				return nil
+			default:
+				return fmt.Errorf("doh: server: udp read failed: %w", err)
+			}
+		}
+
+		query := make([]byte, n)
+		copy(query, buf[:n])
+
+		s.wg.Add(1)
+		go func(raddr net.Addr, query []byte) {
+			defer s.wg.Done()
+			s.handleUDP(raddr, query)
+		}(raddr, query)
+	}
+}
+
+func (s *Server) handleUDP(raddr net.Addr, query []byte) {
+	rsp := s.answer(raddr, query)
+	if rsp == nil {
+		return
+	}
+
+	packed, err := rsp.Pack()
+	if err != nil {
+		return
+	}
+
+	bufSize := uint16(defaultUDPBufferSize)
+	var req dnsmessage.Message
+	if err := req.Unpack(query); err == nil {
+		bufSize = edns0BufferSize(&req)
+	}
+	if len(packed) > int(bufSize) {
+		rsp.Truncated = true
+		rsp.Answers = nil
+		rsp.Authorities = nil
+		rsp.Additionals = nil
+		if packed, err = rsp.Pack(); err != nil {
+			return
+		}
+	}
+
+	_, _ = s.udpConn.WriteTo(packed, raddr)
+}
+
+func (s *Server) serveTCP() error {
+	for {
+		conn, err := s.tcpLn.Accept()
+		if err != nil {
+			select {
+			case <-s.stopc:
+				return nil
+			default:
+				return fmt.Errorf("doh: server: tcp accept failed: %w", err)
+			}
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() { _ = conn.Close() }()
+			s.handleTCP(conn)
+		}()
+	}
+}
+
+// handleTCP serves queries from a single TCP connection, each framed with
+// a 2-byte big-endian length prefix per RFC 1035 section 4.2.2.
+func (s *Server) handleTCP(conn net.Conn) {
+	for {
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		rsp := s.answer(conn.RemoteAddr(), query)
+		if rsp == nil {
+			return
+		}
+
+		packed, err := rsp.Pack()
+		if err != nil {
+			return
+		}
+
+		header := make([]byte, 2)
+		binary.BigEndian.PutUint16(header, uint16(len(packed)))
+		if _, err := conn.Write(append(header, packed...)); err != nil {
+			return
+		}
+	}
+}
+
+// answer parses a wire-format query, forwards it through the DoH client,
+// and returns the wire-format response. It returns nil when the query
+// itself is malformed, since there is no well-formed ID to reply with.
+func (s *Server) answer(raddr net.Addr, query []byte) *dnsmessage.Message {
+	var req dnsmessage.Message
+	if err := req.Unpack(query); err != nil {
+		return nil
+	}
+
+	if len(req.Questions) != 1 {
+		return errorResponse(req.Header, dnsmessage.RCodeFormatError)
+	}
+	q := req.Questions[0]
+
+	if s.limiter != nil && !s.limiter.Allow(clientIP(raddr)) {
+		return errorResponse(req.Header, dnsmessage.RCodeRefused)
+	}
+
+	if s.refuseAny && q.Type == dnsmessage.TypeALL {
+		return errorResponse(req.Header, dnsmessage.RCodeRefused)
+	}
+
+	t, err := typeFromWireType(q.Type)
+	if err != nil {
+		return errorResponse(req.Header, dnsmessage.RCodeNotImplemented)
+	}
+	d := Domain(strings.TrimSuffix(q.Name.String(), "."))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msg, err := s.client.QueryMessage(ctx, d, t)
+	if err != nil {
+		return errorResponse(req.Header, dnsmessage.RCodeServerFailure)
+	}
+
+	msg.ID = req.Header.ID
+	msg.RecursionDesired = req.Header.RecursionDesired
+	msg.Response = true
+	if len(msg.Questions) == 0 {
+		msg.Questions = req.Questions
+	}
+
+	return msg
+}
+
+// errorResponse builds a minimal reply carrying rcode, echoing the
+// original query's ID and opcode.
+func errorResponse(h dnsmessage.Header, rcode dnsmessage.RCode) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:       h.ID,
+			Response: true,
+			OpCode:   h.OpCode,
+			RCode:    rcode,
+		},
+	}
+}
+
+// edns0BufferSize returns the UDP payload size advertised by the client's
+// OPT pseudo-record, or defaultUDPBufferSize if none was sent.
+func edns0BufferSize(msg *dnsmessage.Message) uint16 {
+	for _, a := range msg.Additionals {
+		if a.Header.Type == dnsmessage.TypeOPT {
+			return uint16(a.Header.Class)
+		}
+	}
+	return defaultUDPBufferSize
+}
+
+// clientIP extracts the IP portion of a net.Addr, for rate-limiting
+// purposes.
+func clientIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// rateLimiterMaxBuckets bounds how many distinct client IPs a rateLimiter
+// tracks at once. UDP source IPs are trivially spoofable, so an unbounded
+// per-IP map would itself become a memory-exhaustion vector; buckets is
+// backed by the same bounded LRU cache used for query caching instead.
+const rateLimiterMaxBuckets = 10000
+
+// rateLimiterIdleTTL expires a client's bucket after it has been quiet
+// this long, so idle buckets don't hold a cache slot indefinitely.
+const rateLimiterIdleTTL = 5 * time.Minute
+
+// rateLimiter is a token bucket per client IP.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets *cache
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(ratePerSecond float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    ratePerSecond,
+		burst:   float64(burst),
+		buckets: newCache(rateLimiterMaxBuckets, 0),
+	}
+}
+
+// Allow reports whether a query from ip is within its rate limit,
+// consuming a token if so.
+func (l *rateLimiter) Allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	var b *tokenBucket
+	if v, _, ok := l.buckets.Get(ip); ok {
+		b = v.(*tokenBucket)
+	} else {
+		b = &tokenBucket{tokens: l.burst, last: now}
+	}
+
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	b.tokens += elapsed * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+
+	allow := b.tokens >= 1
+	if allow {
+		b.tokens--
+	}
+
+	l.buckets.Set(ip, b, 1, rateLimiterIdleTTL)
+	return allow
+}
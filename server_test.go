@@ -0,0 +1,82 @@
+package doh
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestEdns0BufferSizeReadsClientOPT(t *testing.T) {
+	msg := &dnsmessage.Message{
+		Additionals: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeOPT, Class: 4096},
+			Body:   &dnsmessage.OPTResource{},
+		}},
+	}
+
+	if got := edns0BufferSize(msg); got != 4096 {
+		t.Errorf("expected the OPT record's class to be read as a 4096 buffer size, got %d", got)
+	}
+}
+
+func TestEdns0BufferSizeDefaultsWithoutOPT(t *testing.T) {
+	msg := &dnsmessage.Message{}
+
+	if got := edns0BufferSize(msg); got != defaultUDPBufferSize {
+		t.Errorf("expected the default buffer size without an OPT record, got %d", got)
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	l := newRateLimiter(1, 3)
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow("1.2.3.4") {
+			t.Fatalf("expected request %d within burst to be allowed", i)
+		}
+	}
+	if l.Allow("1.2.3.4") {
+		t.Error("expected the request beyond burst to be refused")
+	}
+}
+
+func TestRateLimiterPerIPIsolation(t *testing.T) {
+	l := newRateLimiter(1, 1)
+
+	if !l.Allow("1.2.3.4") {
+		t.Fatal("expected the first request from 1.2.3.4 to be allowed")
+	}
+	if !l.Allow("5.6.7.8") {
+		t.Error("expected a different client IP to have its own bucket")
+	}
+}
+
+func TestRateLimiterRefillsOverTime(t *testing.T) {
+	l := newRateLimiter(1000, 1)
+
+	if !l.Allow("1.2.3.4") {
+		t.Fatal("expected the first request to be allowed")
+	}
+	if l.Allow("1.2.3.4") {
+		t.Fatal("expected the immediate second request to be refused")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if !l.Allow("1.2.3.4") {
+		t.Error("expected the bucket to have refilled after waiting")
+	}
+}
+
+func TestRateLimiterBoundsBucketCount(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	l.buckets = newCache(2, 0)
+
+	l.Allow("1.1.1.1")
+	l.Allow("2.2.2.2")
+	l.Allow("3.3.3.3") // should evict 1.1.1.1's bucket
+
+	if _, _, ok := l.buckets.Get("1.1.1.1"); ok {
+		t.Error("expected the oldest bucket to have been evicted once over the cap")
+	}
+}
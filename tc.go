@@ -0,0 +1,141 @@
+package doh
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// truncatedRetryBufferSize is the EDNS0 UDP payload size advertised when
+// retrying a truncated answer.
+const truncatedRetryBufferSize = 4096
+
+// TruncationPolicy controls what happens when a provider's answer has
+// TC set, meaning it was truncated and may be missing records.
+type TruncationPolicy int
+
+const (
+	// TruncationFail returns the truncated response as-is, the
+	// historical behavior: callers must inspect Response.TC themselves.
+	TruncationFail TruncationPolicy = iota
+	// TruncationRetry re-issues the question against the same provider
+	// over POST + application/dns-message with a larger EDNS0 buffer.
+	TruncationRetry
+	// TruncationRetryTCP behaves like TruncationRetry, but if the larger
+	// buffer still truncates, also tries the next provider in the pool.
+	TruncationRetryTCP
+)
+
+// WithTruncationPolicy sets how a truncated (TC=1) answer is handled.
+// The default is TruncationFail.
+func WithTruncationPolicy(policy TruncationPolicy) Option {
+	return func(d *DoH) {
+		d.truncationPolicy = policy
+	}
+}
+
+// handleTruncated applies c.truncationPolicy to a truncated response rsp
+// that was returned by provider idx/u.
+func (c *DoH) handleTruncated(ctx context.Context, idx int, u string, d Domain, t Type, rsp *Response, s ...ECS) (*Response, error) {
+	if c.truncationPolicy == TruncationFail {
+		return rsp, nil
+	}
+
+	retried, err := c.retryTruncated(ctx, u, d, t, s...)
+	if err != nil {
+		// The retry itself failed; the original truncated answer is
+		// still better than nothing.
+		return rsp, nil
+	}
+	if !retried.TC || c.truncationPolicy == TruncationRetry {
+		return retried, nil
+	}
+
+	if nextIdx, nextURL, ok := c.nextProviderAfter(idx); ok {
+		if next, err := c.queryOnce(ctx, nextIdx, nextURL, d, t, s...); err == nil {
+			return next, nil
+		}
+	}
+
+	return retried, nil
+}
+
+// retryTruncated re-issues the question against the same provider over
+// POST + application/dns-message with a larger EDNS0 buffer, per RFC
+// 1035 section 4.2.2 style TCP fallback (DoH has no separate TCP
+// transport, so a bigger wire-format buffer stands in for it).
+func (c *DoH) retryTruncated(ctx context.Context, u string, d Domain, t Type, s ...ECS) (*Response, error) {
+	if len(s) > 0 && s[0] != "" {
+		return nil, fmt.Errorf("doh: edns_client_subnet is not supported when retrying a truncated answer")
+	}
+
+	req, err := c.buildWirePostRequest(ctx, u, d, t, truncatedRetryBufferSize)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := c.doWireRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return messageToResponse(msg, u)
+}
+
+// handleTruncatedMessage is handleTruncated's counterpart for
+// QueryMessage's wire-format path: it applies c.truncationPolicy to a
+// truncated msg that was returned by provider idx/u, without the
+// message<->Response conversion handleTruncated does for Query.
+func (c *DoH) handleTruncatedMessage(ctx context.Context, idx int, u string, d Domain, t Type, msg *dnsmessage.Message, s ...ECS) (*dnsmessage.Message, error) {
+	if c.truncationPolicy == TruncationFail {
+		return msg, nil
+	}
+
+	retried, err := c.retryTruncatedMessage(ctx, u, d, t, s...)
+	if err != nil {
+		// The retry itself failed; the original truncated answer is
+		// still better than nothing.
+		return msg, nil
+	}
+	if !retried.Truncated || c.truncationPolicy == TruncationRetry {
+		return retried, nil
+	}
+
+	if _, nextURL, ok := c.nextProviderAfter(idx); ok {
+		if next, err := c.queryWireMessage(ctx, nextURL, d, t, s...); err == nil {
+			return next, nil
+		}
+	}
+
+	return retried, nil
+}
+
+// retryTruncatedMessage is retryTruncated's counterpart for the
+// wire-format message path.
+func (c *DoH) retryTruncatedMessage(ctx context.Context, u string, d Domain, t Type, s ...ECS) (*dnsmessage.Message, error) {
+	if len(s) > 0 && s[0] != "" {
+		return nil, fmt.Errorf("doh: edns_client_subnet is not supported when retrying a truncated answer")
+	}
+
+	req, err := c.buildWirePostRequest(ctx, u, d, t, truncatedRetryBufferSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.doWireRequest(req)
+}
+
+// nextProviderAfter returns the provider immediately after idx in the
+// pool, wrapping around. ok is false when there is no other provider to
+// try.
+func (c *DoH) nextProviderAfter(idx int) (nextIdx int, url string, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if len(c.urls) < 2 {
+		return 0, "", false
+	}
+	next := (idx + 1) % len(c.urls)
+	return next, c.urls[next], true
+}
@@ -0,0 +1,58 @@
+package doh
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNextProviderAfterWraps(t *testing.T) {
+	c := New(WithProviders([]string{"a", "b", "c"}))
+	defer c.Close()
+
+	idx, url, ok := c.nextProviderAfter(2)
+	if !ok {
+		t.Fatal("expected a next provider to be found")
+	}
+	if idx != 0 || url != "a" {
+		t.Errorf("expected to wrap around to provider 0 (\"a\"), got %d (%q)", idx, url)
+	}
+}
+
+func TestNextProviderAfterSingleProvider(t *testing.T) {
+	c := New(WithProviders([]string{"a"}))
+	defer c.Close()
+
+	if _, _, ok := c.nextProviderAfter(0); ok {
+		t.Error("expected no next provider with only one configured")
+	}
+}
+
+func TestHandleTruncatedFailPolicyPassesThrough(t *testing.T) {
+	c := New(WithProviders([]string{"a"}))
+	defer c.Close()
+
+	rsp := &Response{TC: true}
+	out, err := c.handleTruncated(context.Background(), 0, "a", "example.com", TypeA, rsp)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != rsp {
+		t.Error("expected TruncationFail to return the original response unchanged")
+	}
+}
+
+func TestHandleTruncatedMessageFailPolicyPassesThrough(t *testing.T) {
+	c := New(WithProviders([]string{"a"}))
+	defer c.Close()
+
+	msg := &dnsmessage.Message{Header: dnsmessage.Header{Truncated: true}}
+	out, err := c.handleTruncatedMessage(context.Background(), 0, "a", "example.com", TypeA, msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != msg {
+		t.Error("expected TruncationFail to return the original message unchanged")
+	}
+}
@@ -0,0 +1,506 @@
+package doh
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Transport selects the wire encoding used to talk to a DoH provider.
+type Transport int
+
+const (
+	// TransportJSON speaks the legacy application/dns-json API understood
+	// by Google and most other providers. It is the default.
+	TransportJSON Transport = iota
+	// TransportWire speaks RFC 8484 application/dns-message, the binary
+	// DNS wire format required by strict resolvers such as NextDNS and
+	// AdGuard.
+	TransportWire
+)
+
+// ProviderConfig pairs a DoH provider URL with an explicit Transport,
+// overriding WithWireFormat for that provider.
+type ProviderConfig struct {
+	URL       string
+	Transport Transport
+}
+
+// WithWireFormat switches every provider (other than those pinned via
+// WithProviderConfigs, and URLs ending in "/resolve", which stay on
+// application/dns-json) to RFC 8484 application/dns-message. It is disabled
+// by default, in which case DoH speaks application/dns-json.
+func WithWireFormat(enabled bool) Option {
+	return func(d *DoH) {
+		d.wireFormat = enabled
+	}
+}
+
+// WithProviderConfigs sets the list of DoH providers along with the
+// transport to use for each, taking precedence over WithWireFormat. Like
+// WithProviders, it replaces the provider list, so whichever of the two is
+// applied last sets the URLs.
+func WithProviderConfigs(configs []ProviderConfig) Option {
+	return func(d *DoH) {
+		urls := make([]string, len(configs))
+		transports := make(map[int]Transport, len(configs))
+		for i, cfg := range configs {
+			urls[i] = cfg.URL
+			transports[i] = cfg.Transport
+		}
+		d.urls = urls
+		d.transports = transports
+	}
+}
+
+// transportFor resolves the transport to use for the provider at index i:
+// an explicit ProviderConfig always wins, otherwise WithWireFormat decides,
+// falling back to auto-detection from the URL since Google's legacy
+// "/resolve" endpoint has no wire-format counterpart.
+func (c *DoH) transportFor(i int, u string) Transport {
+	if t, ok := c.transports[i]; ok {
+		return t
+	}
+	if !c.wireFormat {
+		return TransportJSON
+	}
+	if strings.HasSuffix(u, "/resolve") {
+		return TransportJSON
+	}
+	return TransportWire
+}
+
+// QueryMessage behaves like Query but forces RFC 8484 wire-format transport
+// and returns the raw *dnsmessage.Message, for callers that need
+// authoritative bytes (e.g. DNSSEC RRSIGs) rather than the JSON-oriented
+// Response/Answer structs. It shares Query's provider racing (see
+// orderedProviders/headStartAfter), cache (see c.cache) and
+// c.truncationPolicy retry behavior, rather than fanning out to every
+// provider and skipping them, as it once did.
+func (c *DoH) QueryMessage(ctx context.Context, d Domain, t Type, s ...ECS) (*dnsmessage.Message, error) {
+	if c.cache != nil {
+		if msg, ok := c.checkMessageCache(d, t, s...); ok {
+			return msg, nil
+		}
+	}
+
+	ctxs, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	order := c.orderedProviders()
+	if max := c.raceMaxParallel; max > 0 && max < len(order) {
+		order = order[:max]
+	}
+
+	urls := c.urls
+	r := make(chan interface{}, len(order))
+	go c.goQueryMessage(ctxs, order[0], urls[order[0]], d, t, r, s...)
+
+	go func() {
+		prev := order[0]
+		for _, idx := range order[1:] {
+			timer := time.NewTimer(c.headStartAfter(prev))
+			select {
+			case <-ctxs.Done():
+				timer.Stop()
+				r <- goMessageResult{err: ctxs.Err()}
+			case <-timer.C:
+				go c.goQueryMessage(ctxs, idx, urls[idx], d, t, r, s...)
+			}
+			prev = idx
+		}
+	}()
+
+	msg, err := c.collectMessageResponses(r, len(order))
+	if c.cache != nil && msg != nil && (err == nil || msg.RCode == dnsmessage.RCodeNameError || (msg.RCode == dnsmessage.RCodeSuccess && len(msg.Answers) == 0)) {
+		c.updateMessageCache(d, t, msg, s...)
+	}
+
+	return msg, err
+}
+
+// goMessageResult mirrors goResult (doh.go) for the wire-message path.
+type goMessageResult struct {
+	msg *dnsmessage.Message
+	err error
+}
+
+func (c *DoH) goQueryMessage(ctx context.Context, k int, u string, d Domain, t Type, r chan<- interface{}, s ...ECS) {
+	start := time.Now()
+	msg, err := c.queryWireWithTruncation(ctx, k, u, d, t, s...)
+	c.recordStat(k, time.Since(start), err)
+	r <- goMessageResult{msg: msg, err: err}
+}
+
+// collectMessageResponses mirrors collectResponses (doh.go) for the
+// wire-message path.
+func (c *DoH) collectMessageResponses(r chan interface{}, totalUrls int) (*dnsmessage.Message, error) {
+	var firstErr error
+	var failedMsg *dnsmessage.Message
+	total := 0
+	for v := range r {
+		total++
+		if res, ok := v.(goMessageResult); ok {
+			if res.err == nil {
+				return res.msg, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if failedMsg == nil {
+				failedMsg = res.msg
+			}
+		}
+
+		if total >= totalUrls {
+			break
+		}
+	}
+
+	if firstErr != nil {
+		return failedMsg, firstErr
+	}
+	return nil, fmt.Errorf("doh: all %d providers failed to respond", totalUrls)
+}
+
+func (c *DoH) checkMessageCache(d Domain, t Type, s ...ECS) (*dnsmessage.Message, bool) {
+	v, age, ok := c.cache.Get(messageCacheKey(d, t, s...))
+	if !ok {
+		return nil, false
+	}
+	return decrementMessageTTL(v.(*dnsmessage.Message), age), true
+}
+
+// updateMessageCache stores msg for (d, t, s), including negative
+// (NXDOMAIN or empty-answer) results per RFC 2308, with its TTL clamped by
+// WithCacheMinTTL/WithCacheMaxTTL.
+func (c *DoH) updateMessageCache(d Domain, t Type, msg *dnsmessage.Message, s ...ECS) {
+	ttl := c.clampTTL(messageCacheTTL(msg))
+	c.cache.Set(messageCacheKey(d, t, s...), msg, messageCacheEntrySize(msg), ttl)
+}
+
+// queryWireWithTruncation performs a single wire-format query against
+// provider idx/u and applies c.truncationPolicy if the answer comes back
+// truncated, mirroring query() (doh.go) for the JSON/Response path.
+func (c *DoH) queryWireWithTruncation(ctx context.Context, idx int, u string, d Domain, t Type, s ...ECS) (*dnsmessage.Message, error) {
+	msg, err := c.queryWireMessage(ctx, u, d, t, s...)
+	if err != nil || !msg.Truncated {
+		return msg, err
+	}
+
+	return c.handleTruncatedMessage(ctx, idx, u, d, t, msg, s...)
+}
+
+// queryWire performs a single wire-format query and maps the result back
+// onto the existing Response/Answer structs.
+func (c *DoH) queryWire(ctx context.Context, u string, d Domain, t Type, s ...ECS) (*Response, error) {
+	msg, err := c.queryWireMessage(ctx, u, d, t, s...)
+	if msg == nil {
+		return nil, err
+	}
+	rsp, convErr := messageToResponse(msg, u)
+	if convErr != nil {
+		return nil, convErr
+	}
+	// A message that comes with an error (e.g. NXDOMAIN) is still returned,
+	// as doRequest does, so fastQuery can negatively cache it.
+	return rsp, err
+}
+
+func (c *DoH) queryWireMessage(ctx context.Context, u string, d Domain, t Type, s ...ECS) (*dnsmessage.Message, error) {
+	if len(s) > 0 && s[0] != "" {
+		return nil, fmt.Errorf("doh: edns_client_subnet is not yet supported over the wire transport")
+	}
+
+	req, err := c.buildWireRequest(ctx, u, d, t)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.doWireRequest(req)
+}
+
+// buildWireRequest creates an HTTP request carrying a binary DNS question
+// per RFC 8484 section 4.1. GET is used, with the message base64url-encoded
+// in the "dns" query parameter, since it is cacheable by intermediate
+// proxies.
+func (c *DoH) buildWireRequest(ctx context.Context, u string, d Domain, t Type) (*http.Request, error) {
+	msg, err := buildQuestion(d, t)
+	if err != nil {
+		return nil, err
+	}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("doh: failed to pack dns message: %w", err)
+	}
+
+	dnsURL := fmt.Sprintf("%s?dns=%s", u, base64.RawURLEncoding.EncodeToString(packed))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dnsURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("doh: failed to create http request for %s: %w", dnsURL, err)
+	}
+
+	req.Header.Set("Accept", "application/dns-message")
+	req.Header.Set("User-Agent", fmt.Sprintf("%s/%s (%s)", Name, Version, Source))
+
+	return req, nil
+}
+
+// buildWirePostRequest is like buildWireRequest, but POSTs the question
+// with an OPT pseudo-record advertising a udpBufferSize EDNS0 buffer, per
+// RFC 6891. It is used to retry a truncated answer with more room.
+func (c *DoH) buildWirePostRequest(ctx context.Context, u string, d Domain, t Type, udpBufferSize uint16) (*http.Request, error) {
+	msg, err := buildQuestionEDNS0(d, t, udpBufferSize)
+	if err != nil {
+		return nil, err
+	}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("doh: failed to pack dns message: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(packed))
+	if err != nil {
+		return nil, fmt.Errorf("doh: failed to create http request for %s: %w", u, err)
+	}
+
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	req.Header.Set("User-Agent", fmt.Sprintf("%s/%s (%s)", Name, Version, Source))
+
+	return req, nil
+}
+
+// doWireRequest executes req and unpacks the binary DNS message in the
+// response body.
+func (c *DoH) doWireRequest(req *http.Request) (*dnsmessage.Message, error) {
+	u := req.URL.String()
+	rsp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("doh: http request failed for %s: %w", u, err)
+	}
+	defer func() {
+		_ = rsp.Body.Close()
+	}()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: provider %s returned unexpected status code: %d", u, rsp.StatusCode)
+	}
+
+	data, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("doh: failed to read response body from %s: %w", u, err)
+	}
+
+	msg := new(dnsmessage.Message)
+	if err := msg.Unpack(data); err != nil {
+		return nil, fmt.Errorf("doh: failed to unpack dns message from %s: %w", u, err)
+	}
+
+	if msg.RCode != dnsmessage.RCodeSuccess {
+		return msg, fmt.Errorf("doh: provider %s returned error in dns response (status: %d)", u, msg.RCode)
+	}
+
+	return msg, nil
+}
+
+// wireQuestionID is a monotonically increasing counter used to pick DNS
+// message IDs; unlike plain UDP, HTTP framing already correlates requests
+// and responses, so this only needs to be non-repeating for debugging.
+var wireQuestionID uint32
+
+func buildQuestion(d Domain, t Type) (dnsmessage.Message, error) {
+	name, err := d.Punycode()
+	if err != nil {
+		return dnsmessage.Message{}, fmt.Errorf("doh: failed to convert domain to punycode: %w", err)
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	qType, err := wireType(t)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return dnsmessage.Message{}, fmt.Errorf("doh: domain name %q is too long for the wire format: %w", name, err)
+	}
+
+	return dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(atomic.AddUint32(&wireQuestionID, 1)),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{
+			{
+				Name:  qname,
+				Type:  qType,
+				Class: dnsmessage.ClassINET,
+			},
+		},
+	}, nil
+}
+
+// buildQuestionEDNS0 is like buildQuestion, but attaches an OPT
+// pseudo-record advertising a UDP payload size of udpBufferSize.
+func buildQuestionEDNS0(d Domain, t Type, udpBufferSize uint16) (dnsmessage.Message, error) {
+	msg, err := buildQuestion(d, t)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(int(udpBufferSize), dnsmessage.RCodeSuccess, false); err != nil {
+		return dnsmessage.Message{}, fmt.Errorf("doh: failed to set edns0 options: %w", err)
+	}
+	msg.Additionals = append(msg.Additionals, dnsmessage.Resource{
+		Header: opt,
+		Body:   &dnsmessage.OPTResource{},
+	})
+
+	return msg, nil
+}
+
+// wireType maps a doh.Type onto its dnsmessage.Type equivalent. Not every
+// JSON-API type has a wire-format counterpart (e.g. SPF was never assigned
+// a stable RR type), so unsupported types are rejected explicitly.
+func wireType(t Type) (dnsmessage.Type, error) {
+	switch strings.TrimSpace(string(t)) {
+	case string(TypeA):
+		return dnsmessage.TypeA, nil
+	case string(TypeAAAA):
+		return dnsmessage.TypeAAAA, nil
+	case string(TypeCNAME):
+		return dnsmessage.TypeCNAME, nil
+	case string(TypeMX):
+		return dnsmessage.TypeMX, nil
+	case string(TypeTXT):
+		return dnsmessage.TypeTXT, nil
+	case string(TypeNS):
+		return dnsmessage.TypeNS, nil
+	case string(TypeSOA):
+		return dnsmessage.TypeSOA, nil
+	case string(TypePTR):
+		return dnsmessage.TypePTR, nil
+	case string(TypeANY):
+		return dnsmessage.TypeALL, nil
+	default:
+		return 0, fmt.Errorf("doh: type %s is not supported over the wire transport", t)
+	}
+}
+
+// typeFromWireType is the inverse of wireType, used by Server to turn an
+// incoming wire-format question into the Type used by Query/QueryMessage.
+func typeFromWireType(t dnsmessage.Type) (Type, error) {
+	switch t {
+	case dnsmessage.TypeA:
+		return TypeA, nil
+	case dnsmessage.TypeAAAA:
+		return TypeAAAA, nil
+	case dnsmessage.TypeCNAME:
+		return TypeCNAME, nil
+	case dnsmessage.TypeMX:
+		return TypeMX, nil
+	case dnsmessage.TypeTXT:
+		return TypeTXT, nil
+	case dnsmessage.TypeNS:
+		return TypeNS, nil
+	case dnsmessage.TypeSOA:
+		return TypeSOA, nil
+	case dnsmessage.TypePTR:
+		return TypePTR, nil
+	case dnsmessage.TypeALL:
+		return TypeANY, nil
+	default:
+		return "", fmt.Errorf("doh: wire type %d is not supported", t)
+	}
+}
+
+// messageToResponse maps a binary DNS message onto the existing
+// Response/Answer structs so callers using Query don't need to care which
+// transport produced the result.
+func messageToResponse(msg *dnsmessage.Message, provider string) (*Response, error) {
+	rr := &Response{
+		Status:   int(msg.RCode),
+		TC:       msg.Truncated,
+		RD:       msg.RecursionDesired,
+		RA:       msg.RecursionAvailable,
+		AD:       msg.AuthenticData,
+		CD:       msg.CheckingDisabled,
+		Provider: provider,
+	}
+
+	for _, q := range msg.Questions {
+		rr.Question = append(rr.Question, Question{
+			Name: q.Name.String(),
+			Type: int(q.Type),
+		})
+	}
+
+	for _, a := range msg.Answers {
+		rr.Answer = append(rr.Answer, Answer{
+			Name: a.Header.Name.String(),
+			Type: int(a.Header.Type),
+			TTL:  int(a.Header.TTL),
+			Data: resourceData(a.Body),
+		})
+	}
+
+	for _, a := range msg.Authorities {
+		rr.Authority = append(rr.Authority, Answer{
+			Name: a.Header.Name.String(),
+			Type: int(a.Header.Type),
+			TTL:  int(a.Header.TTL),
+			Data: resourceData(a.Body),
+		})
+	}
+
+	return rr, nil
+}
+
+// resourceData renders a resource record body as a string in the same
+// shape the JSON DoH APIs use for their "data" field. Record types that
+// dnsmessage.Unpack decodes as UnknownResource (CAA, TLSA, RRSIG, DNSKEY,
+// NSEC, ...) have their raw RDATA returned hex-encoded, rather than failing
+// the whole response over one record we don't render. Any other body with
+// no dedicated case here (e.g. SRVResource) renders as an empty string.
+func resourceData(body dnsmessage.ResourceBody) string {
+	switch r := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(r.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(r.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return r.CNAME.String()
+	case *dnsmessage.NSResource:
+		return r.NS.String()
+	case *dnsmessage.PTRResource:
+		return r.PTR.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", r.Pref, r.MX.String())
+	case *dnsmessage.TXTResource:
+		return strings.Join(r.TXT, "")
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d %d %d %d %d",
+			r.NS.String(), r.MBox.String(), r.Serial, r.Refresh, r.Retry, r.Expire, r.MinTTL)
+	case *dnsmessage.UnknownResource:
+		return hex.EncodeToString(r.Data)
+	default:
+		return ""
+	}
+}
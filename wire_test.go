@@ -0,0 +1,100 @@
+package doh
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestBuildQuestion(t *testing.T) {
+	msg, err := buildQuestion("example.com", TypeA)
+	if err != nil {
+		t.Fatalf("buildQuestion() returned an unexpected error: %v", err)
+	}
+	if len(msg.Questions) != 1 {
+		t.Fatalf("expected exactly one question, got %d", len(msg.Questions))
+	}
+	if msg.Questions[0].Type != dnsmessage.TypeA {
+		t.Errorf("expected TypeA, got %v", msg.Questions[0].Type)
+	}
+	if got := msg.Questions[0].Name.String(); got != "example.com." {
+		t.Errorf("expected a trailing dot, got %q", got)
+	}
+}
+
+func TestWireTypeRoundTrip(t *testing.T) {
+	types := []Type{TypeA, TypeAAAA, TypeCNAME, TypeMX, TypeTXT, TypeNS, TypeSOA, TypePTR, TypeANY}
+	for _, typ := range types {
+		wt, err := wireType(typ)
+		if err != nil {
+			t.Fatalf("wireType(%s) returned an unexpected error: %v", typ, err)
+		}
+		back, err := typeFromWireType(wt)
+		if err != nil {
+			t.Fatalf("typeFromWireType(%v) returned an unexpected error: %v", wt, err)
+		}
+		if back != typ {
+			t.Errorf("round trip for %s produced %s", typ, back)
+		}
+	}
+}
+
+func TestWireTypeUnsupported(t *testing.T) {
+	if _, err := wireType(TypeSPF); err == nil {
+		t.Error("expected an error for a type with no wire-format counterpart")
+	}
+}
+
+func TestResourceData(t *testing.T) {
+	ip := net.ParseIP("93.184.216.34").To4()
+	var a dnsmessage.AResource
+	copy(a.A[:], ip)
+
+	if got := resourceData(&a); got != "93.184.216.34" {
+		t.Errorf("expected \"93.184.216.34\", got %q", got)
+	}
+}
+
+func TestResourceDataUnknownResourceFallsBackToHex(t *testing.T) {
+	r := &dnsmessage.UnknownResource{Type: 65, Data: []byte{0xca, 0xfe}}
+
+	if got := resourceData(r); got != "cafe" {
+		t.Errorf("expected unrenderable record types to hex-encode their RDATA, got %q", got)
+	}
+}
+
+func TestMessageToResponsePopulatesAuthority(t *testing.T) {
+	var ns dnsmessage.NSResource
+	var err error
+	ns.NS, err = dnsmessage.NewName("ns1.example.com.")
+	if err != nil {
+		t.Fatalf("failed to build test name: %v", err)
+	}
+
+	name, err := dnsmessage.NewName("example.com.")
+	if err != nil {
+		t.Fatalf("failed to build test name: %v", err)
+	}
+
+	msg := &dnsmessage.Message{
+		Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+		Authorities: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeNS, TTL: 300},
+				Body:   &ns,
+			},
+		},
+	}
+
+	rr, err := messageToResponse(msg, "test")
+	if err != nil {
+		t.Fatalf("messageToResponse() returned an unexpected error: %v", err)
+	}
+	if len(rr.Authority) != 1 {
+		t.Fatalf("expected one authority record, got %d", len(rr.Authority))
+	}
+	if rr.Authority[0].Data != "ns1.example.com." {
+		t.Errorf("expected \"ns1.example.com.\", got %q", rr.Authority[0].Data)
+	}
+}